@@ -0,0 +1,247 @@
+// Copyright 2023 Eryx <evorui at gmail dot com>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hmetrics
+
+import (
+	"bytes"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// collectorInterval is how often the process and Go runtime
+// collectors refresh their snapshots.
+const collectorInterval = 15 * time.Second
+
+func init() {
+	if disabled, _ := strconv.ParseBool(os.Getenv("HMETRICS_DISABLE_DEFAULT_COLLECTORS")); disabled {
+		return
+	}
+	RegisterProcessCollector()
+	RegisterGoCollector()
+}
+
+var (
+	processCollectorOnce sync.Once
+	goCollectorOnce      sync.Once
+)
+
+// RegisterProcessCollector starts a background collector that
+// publishes the standard `process_*` metrics (process_cpu_seconds_total,
+// process_resident_memory_bytes, process_virtual_memory_bytes,
+// process_open_fds, process_start_time_seconds) every
+// collectorInterval, so HttpHandler output is immediately useful in
+// dashboards that assume these series exist. It is called
+// automatically from init unless HMETRICS_DISABLE_DEFAULT_COLLECTORS
+// is set to a true-ish value; calling it again is a no-op.
+func RegisterProcessCollector() {
+	processCollectorOnce.Do(func() {
+		go collectorLoop(updateProcessMetrics)
+	})
+}
+
+// RegisterGoCollector starts a background collector that publishes
+// the standard `go_*` metrics (go_goroutines, go_gc_duration_seconds,
+// go_memstats_*) every collectorInterval. It is called automatically
+// from init unless HMETRICS_DISABLE_DEFAULT_COLLECTORS is set to a
+// true-ish value; calling it again is a no-op.
+func RegisterGoCollector() {
+	goCollectorOnce.Do(func() {
+		go collectorLoop(updateGoMetrics)
+	})
+}
+
+func collectorLoop(update func()) {
+	update()
+	ticker := time.NewTicker(collectorInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		update()
+	}
+}
+
+var (
+	collectorMu   sync.Mutex
+	processGauges = map[string]float64{}
+	goGauges      = map[string]float64{}
+	goGCQuantiles []float64
+	goGCSum       float64
+	goGCCount     uint64
+)
+
+// processStats is the set of OS-reported process metrics gathered by
+// platformProcessStats, implemented per-OS in collector_linux.go and
+// collector_other.go.
+type processStats struct {
+	cpuSeconds       float64
+	rssBytes         float64
+	vsizeBytes       float64
+	openFDs          float64
+	startTimeSeconds float64
+}
+
+func updateProcessMetrics() {
+	stats, err := platformProcessStats()
+	if err != nil {
+		return
+	}
+
+	collectorMu.Lock()
+	defer collectorMu.Unlock()
+	processGauges["process_cpu_seconds_total"] = stats.cpuSeconds
+	processGauges["process_resident_memory_bytes"] = stats.rssBytes
+	processGauges["process_virtual_memory_bytes"] = stats.vsizeBytes
+	processGauges["process_open_fds"] = stats.openFDs
+	processGauges["process_start_time_seconds"] = stats.startTimeSeconds
+}
+
+func updateGoMetrics() {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	n := int(ms.NumGC)
+	if n > 256 {
+		n = 256
+	}
+	pauses := make([]float64, n)
+	for i := 0; i < n; i++ {
+		pauses[i] = float64(ms.PauseNs[(int(ms.NumGC)-1-i)%256]) / 1e9
+	}
+	sort.Float64s(pauses)
+
+	collectorMu.Lock()
+	defer collectorMu.Unlock()
+
+	goGauges["go_goroutines"] = float64(runtime.NumGoroutine())
+	goGauges["go_threads"] = float64(runtime.GOMAXPROCS(0))
+	goGauges["go_memstats_alloc_bytes"] = float64(ms.Alloc)
+	goGauges["go_memstats_sys_bytes"] = float64(ms.Sys)
+	goGauges["go_memstats_heap_alloc_bytes"] = float64(ms.HeapAlloc)
+	goGauges["go_memstats_heap_inuse_bytes"] = float64(ms.HeapInuse)
+	goGauges["go_memstats_heap_sys_bytes"] = float64(ms.HeapSys)
+	goGauges["go_memstats_heap_objects"] = float64(ms.HeapObjects)
+	goGauges["go_memstats_stack_inuse_bytes"] = float64(ms.StackInuse)
+	goGauges["go_memstats_gc_sys_bytes"] = float64(ms.GCSys)
+	goGauges["go_memstats_last_gc_time_seconds"] = float64(ms.LastGC) / 1e9
+
+	goGCQuantiles = quantilesOf(pauses, []float64{0, 0.25, 0.5, 0.75, 1})
+	goGCSum = float64(ms.PauseTotalNs) / 1e9
+	goGCCount = uint64(ms.NumGC)
+}
+
+// quantilesOf returns, for each requested phi, the value at that
+// exact rank within the already-sorted samples. Unlike
+// quantileStream.Query this is computed directly over a small,
+// already-materialized sample set (the last up-to-256 GC pauses),
+// matching how the Go runtime itself reports go_gc_duration_seconds.
+func quantilesOf(sorted []float64, phis []float64) []float64 {
+	out := make([]float64, len(phis))
+	if len(sorted) == 0 {
+		return out
+	}
+	for i, phi := range phis {
+		idx := int(phi * float64(len(sorted)-1))
+		out[i] = sorted[idx]
+	}
+	return out
+}
+
+// collectorSample is one label-less process_* or go_* series. Both
+// renderCollectorMetrics (text/OpenMetrics) and collectorProtoFamilies
+// (protobuf) are driven from the same collectorSamples list, so the
+// three exposition formats can never drift out of sync on names,
+// help text, or values.
+type collectorSample struct {
+	name      string
+	help      string
+	isCounter bool
+	value     float64
+}
+
+// collectorSamples returns a snapshot of every simple (non-summary)
+// process_* and go_* series gathered by RegisterProcessCollector and
+// RegisterGoCollector.
+func collectorSamples() []collectorSample {
+	collectorMu.Lock()
+	defer collectorMu.Unlock()
+
+	return []collectorSample{
+		{"process_cpu_seconds_total", "Total user and system CPU time spent in seconds.", true, processGauges["process_cpu_seconds_total"]},
+		{"process_resident_memory_bytes", "Resident memory size in bytes.", false, processGauges["process_resident_memory_bytes"]},
+		{"process_virtual_memory_bytes", "Virtual memory size in bytes.", false, processGauges["process_virtual_memory_bytes"]},
+		{"process_open_fds", "Number of open file descriptors.", false, processGauges["process_open_fds"]},
+		{"process_start_time_seconds", "Start time of the process since unix epoch in seconds.", false, processGauges["process_start_time_seconds"]},
+
+		{"go_goroutines", "Number of goroutines that currently exist.", false, goGauges["go_goroutines"]},
+		{"go_threads", "Number of OS threads available to the Go runtime (GOMAXPROCS).", false, goGauges["go_threads"]},
+		{"go_memstats_alloc_bytes", "Number of bytes allocated and still in use.", false, goGauges["go_memstats_alloc_bytes"]},
+		{"go_memstats_sys_bytes", "Number of bytes obtained from the OS.", false, goGauges["go_memstats_sys_bytes"]},
+		{"go_memstats_heap_alloc_bytes", "Number of heap bytes allocated and still in use.", false, goGauges["go_memstats_heap_alloc_bytes"]},
+		{"go_memstats_heap_inuse_bytes", "Number of heap bytes that are in use.", false, goGauges["go_memstats_heap_inuse_bytes"]},
+		{"go_memstats_heap_sys_bytes", "Number of heap bytes obtained from the OS.", false, goGauges["go_memstats_heap_sys_bytes"]},
+		{"go_memstats_heap_objects", "Number of allocated objects.", false, goGauges["go_memstats_heap_objects"]},
+		{"go_memstats_stack_inuse_bytes", "Number of bytes in use by the stack allocator.", false, goGauges["go_memstats_stack_inuse_bytes"]},
+		{"go_memstats_gc_sys_bytes", "Number of bytes used for garbage collection system metadata.", false, goGauges["go_memstats_gc_sys_bytes"]},
+		{"go_memstats_last_gc_time_seconds", "Time of last garbage collection since unix epoch in seconds.", false, goGauges["go_memstats_last_gc_time_seconds"]},
+	}
+}
+
+// goGCDurationQuantiles are the quantile objectives go_gc_duration_seconds
+// reports, matching what the Go runtime itself exposes.
+var goGCDurationQuantiles = []float64{0, 0.25, 0.5, 0.75, 1}
+
+// goGCDurationSample snapshots the go_gc_duration_seconds summary
+// (quantiles, sum, count) gathered by RegisterGoCollector.
+func goGCDurationSample() (quantiles []float64, sum float64, count uint64) {
+	collectorMu.Lock()
+	defer collectorMu.Unlock()
+
+	quantiles = make([]float64, len(goGCDurationQuantiles))
+	copy(quantiles, goGCQuantiles)
+	return quantiles, goGCSum, goGCCount
+}
+
+// renderCollectorMetrics appends the process_* and go_* series
+// gathered by RegisterProcessCollector and RegisterGoCollector to w,
+// each with HELP and TYPE lines followed by label-less writeEntry
+// samples.
+func renderCollectorMetrics(w *bytes.Buffer) {
+	for _, s := range collectorSamples() {
+		typ := "gauge"
+		if s.isCounter {
+			typ = "counter"
+		}
+		w.WriteString("# HELP " + s.name + " " + s.help + "\n")
+		w.WriteString("# TYPE " + s.name + " " + typ + "\n")
+		writeEntry(w, s.name, s.value, "", map[string]string{}, "", 0)
+	}
+
+	quantiles, sum, count := goGCDurationSample()
+	w.WriteString("# HELP go_gc_duration_seconds A summary of the pause duration of garbage collection cycles.\n")
+	w.WriteString("# TYPE go_gc_duration_seconds summary\n")
+	for i, phi := range goGCDurationQuantiles {
+		v := 0.0
+		if i < len(quantiles) {
+			v = quantiles[i]
+		}
+		writeEntry(w, "go_gc_duration_seconds", v, "", map[string]string{}, "quantile", phi)
+	}
+	writeEntry(w, "go_gc_duration_seconds", sum, "_sum", map[string]string{}, "", 0)
+	writeEntry(w, "go_gc_duration_seconds", float64(count), "_count", map[string]string{}, "", 0)
+	w.WriteByte('\n')
+}
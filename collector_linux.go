@@ -0,0 +1,110 @@
+// Copyright 2023 Eryx <evorui at gmail dot com>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+
+package hmetrics
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+// clockTicksPerSecond is the kernel's USER_HZ, almost universally 100
+// on Linux. It is used to convert /proc/self/stat's jiffy-denominated
+// fields into seconds.
+const clockTicksPerSecond = 100
+
+// platformProcessStats reads /proc/self/{stat,status,fd} to gather
+// the standard process_* metrics on Linux.
+func platformProcessStats() (processStats, error) {
+	var stats processStats
+
+	statLine, err := os.ReadFile("/proc/self/stat")
+	if err != nil {
+		return stats, err
+	}
+	fields := splitProcStat(string(statLine))
+	if len(fields) > 21 {
+		utime, _ := strconv.ParseFloat(fields[13], 64)
+		stime, _ := strconv.ParseFloat(fields[14], 64)
+		stats.cpuSeconds = (utime + stime) / clockTicksPerSecond
+
+		startTicks, _ := strconv.ParseFloat(fields[21], 64)
+		if btime, err := bootTimeSeconds(); err == nil {
+			stats.startTimeSeconds = btime + startTicks/clockTicksPerSecond
+		}
+	}
+
+	status, err := os.ReadFile("/proc/self/status")
+	if err == nil {
+		for _, line := range strings.Split(string(status), "\n") {
+			switch {
+			case strings.HasPrefix(line, "VmRSS:"):
+				stats.rssBytes = parseStatusKB(line)
+			case strings.HasPrefix(line, "VmSize:"):
+				stats.vsizeBytes = parseStatusKB(line)
+			}
+		}
+	}
+
+	if fds, err := os.ReadDir("/proc/self/fd"); err == nil {
+		stats.openFDs = float64(len(fds))
+	}
+
+	return stats, nil
+}
+
+// splitProcStat splits a /proc/self/stat line into its
+// space-separated fields, skipping over the "(comm)" field which may
+// itself contain spaces or parentheses.
+func splitProcStat(line string) []string {
+	end := strings.LastIndex(line, ")")
+	if end < 0 {
+		return strings.Fields(line)
+	}
+	fields := []string{"pid", "comm"}
+	fields = append(fields, strings.Fields(line[end+1:])...)
+	return fields
+}
+
+// parseStatusKB parses a "Key:\t1234 kB" line from /proc/self/status
+// into a byte count.
+func parseStatusKB(line string) float64 {
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return 0
+	}
+	kb, _ := strconv.ParseFloat(fields[1], 64)
+	return kb * 1024
+}
+
+// bootTimeSeconds returns the system boot time (the "btime" line in
+// /proc/stat) as unix seconds.
+func bootTimeSeconds() (float64, error) {
+	data, err := os.ReadFile("/proc/stat")
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "btime ") {
+			fields := strings.Fields(line)
+			if len(fields) == 2 {
+				return strconv.ParseFloat(fields[1], 64)
+			}
+		}
+	}
+	return 0, os.ErrNotExist
+}
@@ -0,0 +1,24 @@
+// Copyright 2023 Eryx <evorui at gmail dot com>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux
+
+package hmetrics
+
+// platformProcessStats has no /proc filesystem to read on non-Linux
+// platforms, so the process_* metrics are registered but report zero
+// until a platform-specific implementation is added.
+func platformProcessStats() (processStats, error) {
+	return processStats{}, nil
+}
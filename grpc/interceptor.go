@@ -0,0 +1,256 @@
+// Copyright 2023 Eryx <evorui at gmail dot com>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package grpc provides gRPC server and client interceptors that
+// publish RED (rate, errors, duration) metrics through hmetrics,
+// without requiring each handler to be instrumented by hand.
+package grpc
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/hooto/hmetrics"
+)
+
+var (
+	mu sync.Mutex
+
+	serverHandling hmetrics.MetricComplexMap
+	serverMsgRecv  hmetrics.MetricCounterMap
+	serverMsgSent  hmetrics.MetricCounterMap
+	clientHandling hmetrics.MetricComplexMap
+	clientMsgSent  hmetrics.MetricCounterMap
+	clientMsgRecv  hmetrics.MetricCounterMap
+)
+
+func serverHandlingMap() hmetrics.MetricComplexMap {
+	mu.Lock()
+	defer mu.Unlock()
+	if serverHandling == nil {
+		serverHandling = hmetrics.RegisterComplexMap(
+			"grpc_server_handling",
+			"Metrics for gRPC requests handled by the server, keyed by full method name.",
+			hmetrics.NewBuckets(0.001, 2, 16),
+		)
+	}
+	return serverHandling
+}
+
+func serverMsgReceivedMap() hmetrics.MetricCounterMap {
+	mu.Lock()
+	defer mu.Unlock()
+	if serverMsgRecv == nil {
+		serverMsgRecv = hmetrics.RegisterCounterMap(
+			"grpc_server_msg_received_total",
+			"Total number of stream messages received by the server.",
+		)
+	}
+	return serverMsgRecv
+}
+
+func serverMsgSentMap() hmetrics.MetricCounterMap {
+	mu.Lock()
+	defer mu.Unlock()
+	if serverMsgSent == nil {
+		serverMsgSent = hmetrics.RegisterCounterMap(
+			"grpc_server_msg_sent_total",
+			"Total number of stream messages sent by the server.",
+		)
+	}
+	return serverMsgSent
+}
+
+func clientHandlingMap() hmetrics.MetricComplexMap {
+	mu.Lock()
+	defer mu.Unlock()
+	if clientHandling == nil {
+		clientHandling = hmetrics.RegisterComplexMap(
+			"grpc_client_handling",
+			"Metrics for gRPC requests issued by the client, keyed by full method name.",
+			hmetrics.NewBuckets(0.001, 2, 16),
+		)
+	}
+	return clientHandling
+}
+
+func clientMsgSentMap() hmetrics.MetricCounterMap {
+	mu.Lock()
+	defer mu.Unlock()
+	if clientMsgSent == nil {
+		clientMsgSent = hmetrics.RegisterCounterMap(
+			"grpc_client_msg_sent_total",
+			"Total number of stream messages sent by the client.",
+		)
+	}
+	return clientMsgSent
+}
+
+func clientMsgReceivedMap() hmetrics.MetricCounterMap {
+	mu.Lock()
+	defer mu.Unlock()
+	if clientMsgRecv == nil {
+		clientMsgRecv = hmetrics.RegisterCounterMap(
+			"grpc_client_msg_received_total",
+			"Total number of stream messages received by the client.",
+		)
+	}
+	return clientMsgRecv
+}
+
+// UnaryServerInterceptor returns a grpc.UnaryServerInterceptor that
+// records one "grpc_server_handling" observation per RPC: a count of
+// 1 and the call's duration, labeled by the RPC's status code, plus an
+// in-flight gauge kept under the "inflight" label. The bookkeeping runs from a defer, so a
+// handler that panics (e.g. ahead of a separate recovery interceptor
+// in the chain) still releases the in-flight gauge and is still
+// recorded, as codes.Internal, before the panic propagates.
+func UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	m := serverHandlingMap()
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp any, err error) {
+		start := time.Now()
+		m.Add(info.FullMethod, "inflight", 0, 1, -1)
+		defer func() {
+			if r := recover(); r != nil {
+				m.Add(info.FullMethod, "inflight", 0, -1, -1)
+				m.Add(info.FullMethod, codes.Internal.String(), 1, 0, time.Since(start))
+				panic(r)
+			}
+			m.Add(info.FullMethod, "inflight", 0, -1, -1)
+			m.Add(info.FullMethod, statusCode(err), 1, 0, time.Since(start))
+		}()
+
+		resp, err = handler(ctx, req)
+		return resp, err
+	}
+}
+
+// StreamServerInterceptor returns a grpc.StreamServerInterceptor that
+// records the same "grpc_server_handling" observation as
+// UnaryServerInterceptor, plus a counted message for every stream
+// message sent or received over the RPC's lifetime. As with
+// UnaryServerInterceptor, the bookkeeping runs from a defer so a
+// panicking handler still releases the in-flight gauge.
+func StreamServerInterceptor() grpc.StreamServerInterceptor {
+	m := serverHandlingMap()
+	recv := serverMsgReceivedMap()
+	sent := serverMsgSentMap()
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+		start := time.Now()
+		m.Add(info.FullMethod, "inflight", 0, 1, -1)
+		defer func() {
+			if r := recover(); r != nil {
+				m.Add(info.FullMethod, "inflight", 0, -1, -1)
+				m.Add(info.FullMethod, codes.Internal.String(), 1, 0, time.Since(start))
+				panic(r)
+			}
+			m.Add(info.FullMethod, "inflight", 0, -1, -1)
+			m.Add(info.FullMethod, statusCode(err), 1, 0, time.Since(start))
+		}()
+
+		err = handler(srv, &countingServerStream{ServerStream: ss, fullMethod: info.FullMethod, recv: recv, sent: sent})
+		return err
+	}
+}
+
+// UnaryClientInterceptor returns a grpc.UnaryClientInterceptor that
+// records one "grpc_client_handling" observation per RPC, mirroring
+// UnaryServerInterceptor from the caller's side.
+func UnaryClientInterceptor() grpc.UnaryClientInterceptor {
+	m := clientHandlingMap()
+	return func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		start := time.Now()
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		m.Add(method, statusCode(err), 1, 0, time.Since(start))
+		return err
+	}
+}
+
+// StreamClientInterceptor returns a grpc.StreamClientInterceptor that
+// records the same "grpc_client_handling" observation as
+// UnaryClientInterceptor, plus a counted message for every stream
+// message sent or received over the RPC's lifetime.
+func StreamClientInterceptor() grpc.StreamClientInterceptor {
+	m := clientHandlingMap()
+	sent := clientMsgSentMap()
+	recv := clientMsgReceivedMap()
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		start := time.Now()
+		cs, err := streamer(ctx, desc, cc, method, opts...)
+		m.Add(method, statusCode(err), 1, 0, time.Since(start))
+		if err != nil {
+			return cs, err
+		}
+		return &countingClientStream{ClientStream: cs, method: method, sent: sent, recv: recv}, nil
+	}
+}
+
+// statusCode returns the gRPC status code of err (codes.OK for a nil
+// err), formatted as used for metric label values.
+func statusCode(err error) string {
+	return status.Code(err).String()
+}
+
+// countingServerStream wraps a grpc.ServerStream to count every
+// message sent to or received from the client.
+type countingServerStream struct {
+	grpc.ServerStream
+	fullMethod string
+	recv, sent hmetrics.MetricCounterMap
+}
+
+func (s *countingServerStream) SendMsg(m any) error {
+	err := s.ServerStream.SendMsg(m)
+	if err == nil {
+		s.sent.Add(s.fullMethod, "", 1)
+	}
+	return err
+}
+
+func (s *countingServerStream) RecvMsg(m any) error {
+	err := s.ServerStream.RecvMsg(m)
+	if err == nil {
+		s.recv.Add(s.fullMethod, "", 1)
+	}
+	return err
+}
+
+// countingClientStream wraps a grpc.ClientStream to count every
+// message sent to or received from the server.
+type countingClientStream struct {
+	grpc.ClientStream
+	method     string
+	sent, recv hmetrics.MetricCounterMap
+}
+
+func (s *countingClientStream) SendMsg(m any) error {
+	err := s.ClientStream.SendMsg(m)
+	if err == nil {
+		s.sent.Add(s.method, "", 1)
+	}
+	return err
+}
+
+func (s *countingClientStream) RecvMsg(m any) error {
+	err := s.ClientStream.RecvMsg(m)
+	if err == nil {
+		s.recv.Add(s.method, "", 1)
+	}
+	return err
+}
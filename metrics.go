@@ -17,6 +17,7 @@ package hmetrics
 import (
 	"bytes"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 
@@ -45,6 +46,12 @@ type MetricHistogramMap interface {
 
 type MetricComplexMap interface {
 	Add(name, item string, c float64, g float64, t time.Duration)
+
+	// AddWithExemplar behaves like Add, but additionally attaches the
+	// given trace/span identifiers as an exemplar on the histogram
+	// bucket covering h. Exemplars are only rendered by the
+	// OpenMetrics exposition format; see HttpHandler.
+	AddWithExemplar(name, item string, c, g float64, h time.Duration, traceID, spanID string)
 }
 
 var (
@@ -103,9 +110,24 @@ func NewBuckets(start, factor float64, count int) []float64 {
 	return buckets
 }
 
-func HttpHandler(w http.ResponseWriter, _ *http.Request) {
+func HttpHandler(w http.ResponseWriter, r *http.Request) {
 	var buf bytes.Buffer
-	translateMetricsToPrometheusTextFormat(&buf, metrics.Snapshot())
+	switch accept := r.Header.Get("Accept"); {
+	case strings.Contains(accept, "application/openmetrics-text"):
+		w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+		translateMetricsToOpenMetricsTextFormat(&buf, metrics.Snapshot())
+	case strings.Contains(accept, "application/vnd.google.protobuf"):
+		w.Header().Set("Content-Type", ProtoContentType)
+		if err := translateMetricsToProtoFormat(&buf, metrics.Snapshot()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	default:
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		translateMetricsToPrometheusTextFormat(&buf, metrics.Snapshot())
+		translateSummaries(&buf)
+		renderCollectorMetrics(&buf)
+	}
 	w.Write(buf.Bytes())
 }
 
@@ -150,9 +172,10 @@ func (it *histogramMap) Add(name, item string, v float64) {
 }
 
 type complexMap struct {
-	counter   *metrics.MetricMap[Label]
-	gauge     *metrics.MetricMap[Label]
-	histogram *metrics.MetricMap[Label]
+	histogramName string
+	counter       *metrics.MetricMap[Label]
+	gauge         *metrics.MetricMap[Label]
+	histogram     *metrics.MetricMap[Label]
 }
 
 func RegisterComplexMap(name, help string, buckets []float64) MetricComplexMap {
@@ -160,7 +183,9 @@ func RegisterComplexMap(name, help string, buckets []float64) MetricComplexMap {
 	defer mu.Unlock()
 	m, ok := complexMetrics[name]
 	if !ok {
+		histogramName := name + "_histogram"
 		m = &complexMap{
+			histogramName: histogramName,
 			counter: metrics.RegisterMap[Label](
 				protos.MetricType_COUNTER,
 				name+"_counter",
@@ -175,7 +200,7 @@ func RegisterComplexMap(name, help string, buckets []float64) MetricComplexMap {
 			),
 			histogram: metrics.RegisterMap[Label](
 				protos.MetricType_HISTOGRAM,
-				name+"_histogram",
+				histogramName,
 				help,
 				buckets,
 			),
@@ -198,3 +223,10 @@ func (it *complexMap) Add(name, item string, c, g float64, h time.Duration) {
 		it.histogram.Get(l).Put(h.Seconds())
 	}
 }
+
+func (it *complexMap) AddWithExemplar(name, item string, c, g float64, h time.Duration, traceID, spanID string) {
+	it.Add(name, item, c, g, h)
+	if h >= 0 {
+		setExemplar(it.histogramName, exemplarKey(name, item), h.Seconds(), traceID, spanID)
+	}
+}
@@ -0,0 +1,222 @@
+// Copyright 2023 Eryx <evorui at gmail dot com>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hmetrics
+
+import (
+	"bytes"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ServiceWeaver/weaver/runtime/metrics"
+	"github.com/ServiceWeaver/weaver/runtime/protos"
+	"golang.org/x/exp/maps"
+)
+
+// exemplar holds the most recent trace correlated with a histogram
+// observation, keyed by the full (post-suffix) histogram metric name
+// and label pair. It is populated by MetricComplexMap.AddWithExemplar
+// and read, without being removed, by
+// translateMetricsToOpenMetricsTextFormat on every scrape.
+type exemplar struct {
+	value   float64
+	traceID string
+	spanID  string
+	ts      time.Time
+}
+
+var (
+	exemplarMu sync.Mutex
+	exemplars  = map[string]exemplar{}
+)
+
+func exemplarKey(name, item string) string {
+	return name + "\xff" + item
+}
+
+func setExemplar(name, item string, v float64, traceID, spanID string) {
+	if traceID == "" && spanID == "" {
+		return
+	}
+	exemplarMu.Lock()
+	exemplars[exemplarKey(name, item)] = exemplar{
+		value:   v,
+		traceID: traceID,
+		spanID:  spanID,
+		ts:      time.Now(),
+	}
+	exemplarMu.Unlock()
+}
+
+func getExemplar(name, item string) (exemplar, bool) {
+	exemplarMu.Lock()
+	e, ok := exemplars[exemplarKey(name, item)]
+	exemplarMu.Unlock()
+	return e, ok
+}
+
+// createdTimes records, for each counter (by full name and label
+// pair), the time it was first rendered by translateMetricsOpenMetrics,
+// so that OpenMetrics `_created` lines report a stable timestamp across
+// scrapes. It is not the time the counter was first incremented.
+var (
+	createdMu    sync.Mutex
+	createdTimes = map[string]float64{}
+)
+
+func createdTime(name, item string) float64 {
+	key := exemplarKey(name, item)
+	createdMu.Lock()
+	defer createdMu.Unlock()
+	if ts, ok := createdTimes[key]; ok {
+		return ts
+	}
+	ts := float64(time.Now().UnixNano()) / 1e9
+	createdTimes[key] = ts
+	return ts
+}
+
+// unitOf returns the OpenMetrics UNIT for a metric name, inferred from
+// its conventional suffix (e.g. "http_request_duration_seconds" ->
+// "seconds"). It returns "" when no unit can be inferred, in which
+// case no UNIT line is emitted.
+func unitOf(name string) string {
+	for _, unit := range []string{"seconds", "bytes", "ratio"} {
+		if strings.HasSuffix(name, "_"+unit) {
+			return unit
+		}
+	}
+	return ""
+}
+
+// translateMetricsToOpenMetricsTextFormat translates Service Weaver
+// metrics to the OpenMetrics text format [1], the successor to the
+// legacy Prometheus text format that adds UNIT/_created metadata and
+// exemplars.
+//
+// [1] https://github.com/OpenObservability/OpenMetrics/blob/main/specification/OpenMetrics.md
+func translateMetricsToOpenMetricsTextFormat(w *bytes.Buffer, ms []*metrics.MetricSnapshot) {
+	sort.SliceStable(ms, func(i, j int) bool {
+		if ms[i].Name != ms[j].Name {
+			return ms[i].Name < ms[j].Name
+		}
+		return ms[i].Id < ms[j].Id
+	})
+
+	grouped := map[string][]*metrics.MetricSnapshot{}
+	for _, m := range ms {
+		grouped[m.Name] = append(grouped[m.Name], m)
+	}
+	sortedNames := maps.Keys(grouped)
+	sort.Strings(sortedNames)
+
+	for _, name := range sortedNames {
+		translateMetricsOpenMetrics(w, grouped[name])
+	}
+	translateSummaries(w)
+	renderCollectorMetrics(w)
+	w.WriteString("# EOF\n")
+}
+
+// translateMetricsOpenMetrics writes a single metric family (HELP,
+// TYPE, optional UNIT, and one sample block per label set) in
+// OpenMetrics format.
+//
+// OpenMetrics mandates that every COUNTER's value sample end in
+// `_total` (e.g. `x_total 5`), while HELP/TYPE/UNIT/`_created` all
+// use the bare metric name (`x`, not `x_total`). The underlying
+// Service Weaver metric name is not guaranteed to already end in
+// `_total` (RegisterComplexMap's "_counter" suffix, for instance), so
+// bareName strips a pre-existing `_total` suffix once and both the
+// metadata lines and the `_total` sample are derived from it.
+func translateMetricsOpenMetrics(w *bytes.Buffer, ms []*metrics.MetricSnapshot) {
+	metric := ms[0]
+	isCounter := metric.Type == protos.MetricType_COUNTER
+	bareName := metric.Name
+	if isCounter {
+		bareName = strings.TrimSuffix(bareName, "_total")
+	}
+
+	if len(metric.Help) > 0 {
+		w.WriteString("# HELP " + bareName + " " + metric.Help + "\n")
+	}
+
+	w.WriteString("# TYPE " + bareName)
+	isHistogram := false
+	switch metric.Type {
+	case protos.MetricType_COUNTER:
+		w.WriteString(" counter\n")
+	case protos.MetricType_GAUGE:
+		w.WriteString(" gauge\n")
+	case protos.MetricType_HISTOGRAM:
+		w.WriteString(" histogram\n")
+		isHistogram = true
+	}
+
+	if unit := unitOf(bareName); unit != "" {
+		w.WriteString("# UNIT " + bareName + " " + unit + "\n")
+	}
+
+	for _, metric := range ms {
+		labels := maps.Clone(metric.Labels)
+		labelKey := exemplarKey(labels["Name"], labels["Item"])
+
+		switch {
+		case isHistogram:
+			hasInf := false
+			prevBound := math.Inf(-1)
+			var count uint64
+			for idx, bound := range metric.Bounds {
+				count += metric.Counts[idx]
+				writeOpenMetricsEntry(w, metric.Name, float64(count), "_bucket", labels, "le", bound, metric.Name, labelKey, prevBound)
+				prevBound = bound
+				if math.IsInf(bound, +1) {
+					hasInf = true
+				}
+			}
+			count += metric.Counts[len(metric.Bounds)]
+			if !hasInf {
+				writeOpenMetricsEntry(w, metric.Name, float64(count), "_bucket", labels, "le", math.Inf(+1), metric.Name, labelKey, prevBound)
+			}
+			writeEntry(w, metric.Name, metric.Value, "_sum", labels, "", 0)
+			writeEntry(w, metric.Name, float64(count), "_count", labels, "", 0)
+		case isCounter:
+			writeEntry(w, bareName, metric.Value, "_total", labels, "", 0)
+			writeEntry(w, bareName, createdTime(bareName, labelKey), "_created", labels, "", 0)
+		default:
+			writeEntry(w, metric.Name, metric.Value, "", labels, "", 0)
+		}
+	}
+}
+
+// writeOpenMetricsEntry writes a histogram bucket line, appending the
+// most recent exemplar on the bucket whose "le" bound first covers
+// the exemplar's observed value (i.e. prevBound < value <= bound).
+func writeOpenMetricsEntry(w *bytes.Buffer, metricName string, value float64, suffix string,
+	labels map[string]string, extraLabelName string, extraLabelItem float64, histogramName, item string, prevBound float64) {
+	writeEntry(w, metricName, value, suffix, labels, extraLabelName, extraLabelItem)
+
+	e, ok := getExemplar(histogramName, item)
+	if !ok || e.value > extraLabelItem || e.value <= prevBound {
+		return
+	}
+	w.Truncate(w.Len() - 1) // drop the trailing newline so we can append the exemplar
+	w.WriteString(" # {trace_id=\"" + e.traceID + "\",span_id=\"" + e.spanID + "\"} " +
+		strconv.FormatFloat(e.value, 'f', -1, 64) + " " +
+		strconv.FormatFloat(float64(e.ts.UnixNano())/1e9, 'f', -1, 64) + "\n")
+}
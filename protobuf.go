@@ -0,0 +1,293 @@
+// Copyright 2023 Eryx <evorui at gmail dot com>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hmetrics
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"sort"
+
+	"github.com/ServiceWeaver/weaver/runtime/metrics"
+	"github.com/ServiceWeaver/weaver/runtime/protos"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+// ProtoContentType is the Accept/Content-Type value that selects the
+// length-delimited protobuf exposition format, as used by Prometheus
+// federation and remote-scrape aggregators that prefer it over text
+// for large label cardinalities.
+const ProtoContentType = "application/vnd.google.protobuf; proto=io.prometheus.client.MetricFamily; encoding=delimited"
+
+// translateMetricsToProtoFormat writes ms as a sequence of
+// io.prometheus.client.MetricFamily protobuf messages to w, each
+// prefixed with its encoded length as an unsigned varint [1].
+//
+// [1] https://github.com/prometheus/client_model
+func translateMetricsToProtoFormat(w io.Writer, ms []*metrics.MetricSnapshot) error {
+	sort.SliceStable(ms, func(i, j int) bool {
+		if ms[i].Name != ms[j].Name {
+			return ms[i].Name < ms[j].Name
+		}
+		return ms[i].Id < ms[j].Id
+	})
+
+	grouped := map[string][]*metrics.MetricSnapshot{}
+	for _, m := range ms {
+		grouped[m.Name] = append(grouped[m.Name], m)
+	}
+	names := make([]string, 0, len(grouped))
+	for name := range grouped {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		mf, err := protoMetricFamily(grouped[name])
+		if err != nil {
+			return err
+		}
+		if err := writeDelimitedProto(w, mf); err != nil {
+			return err
+		}
+	}
+
+	// Summaries and the process_*/go_* collectors live outside the
+	// Service Weaver metrics.Snapshot() used above, so they need to be
+	// appended explicitly here too - otherwise they'd only show up in
+	// the text and OpenMetrics formats, and silently vanish from
+	// anything scraping with ProtoContentType.
+	for _, mf := range summaryProtoFamilies() {
+		if err := writeDelimitedProto(w, mf); err != nil {
+			return err
+		}
+	}
+	for _, mf := range collectorProtoFamilies() {
+		if err := writeDelimitedProto(w, mf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// summaryProtoFamilies renders every registered MetricSummaryMap as
+// dto.MetricFamily messages, mirroring translateSummaries' text
+// output.
+func summaryProtoFamilies() []*dto.MetricFamily {
+	mu.Lock()
+	names := make([]string, 0, len(summaryMetrics))
+	for name := range summaryMetrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	sms := make([]*summaryMap, 0, len(names))
+	for _, name := range names {
+		sms = append(sms, summaryMetrics[name])
+	}
+	mu.Unlock()
+
+	families := make([]*dto.MetricFamily, 0, len(sms))
+	for _, sm := range sms {
+		mf := &dto.MetricFamily{
+			Name: proto.String(sm.name),
+			Type: dto.MetricType_SUMMARY.Enum(),
+		}
+		if len(sm.help) > 0 {
+			mf.Help = proto.String(sm.help)
+		}
+
+		sm.mu.Lock()
+		labels := make([]Label, 0, len(sm.streams))
+		for l := range sm.streams {
+			labels = append(labels, l)
+		}
+		sm.mu.Unlock()
+		sort.Slice(labels, func(i, j int) bool {
+			if labels[i].Name != labels[j].Name {
+				return labels[i].Name < labels[j].Name
+			}
+			return labels[i].Item < labels[j].Item
+		})
+
+		for _, l := range labels {
+			s := sm.streams[l]
+			quantiles := make([]*dto.Quantile, 0, len(sm.objectives))
+			for _, phi := range sm.objectives {
+				quantiles = append(quantiles, &dto.Quantile{
+					Quantile: proto.Float64(phi),
+					Value:    proto.Float64(s.Query(phi)),
+				})
+			}
+			mf.Metric = append(mf.Metric, &dto.Metric{
+				Label: protoLabels(map[string]string{"Name": l.Name, "Item": l.Item}),
+				Summary: &dto.Summary{
+					SampleCount: proto.Uint64(s.Count()),
+					SampleSum:   proto.Float64(s.Sum()),
+					Quantile:    quantiles,
+				},
+			})
+		}
+		families = append(families, mf)
+	}
+	return families
+}
+
+// collectorProtoFamilies renders the process_*/go_* series gathered
+// by RegisterProcessCollector and RegisterGoCollector as
+// dto.MetricFamily messages, mirroring renderCollectorMetrics' text
+// output.
+func collectorProtoFamilies() []*dto.MetricFamily {
+	families := make([]*dto.MetricFamily, 0, len(collectorSamples())+1)
+	for _, s := range collectorSamples() {
+		mf := &dto.MetricFamily{
+			Name: proto.String(s.name),
+			Help: proto.String(s.help),
+		}
+		metric := &dto.Metric{}
+		if s.isCounter {
+			mf.Type = dto.MetricType_COUNTER.Enum()
+			metric.Counter = &dto.Counter{Value: proto.Float64(s.value)}
+		} else {
+			mf.Type = dto.MetricType_GAUGE.Enum()
+			metric.Gauge = &dto.Gauge{Value: proto.Float64(s.value)}
+		}
+		mf.Metric = append(mf.Metric, metric)
+		families = append(families, mf)
+	}
+
+	values, sum, count := goGCDurationSample()
+	gc := &dto.MetricFamily{
+		Name: proto.String("go_gc_duration_seconds"),
+		Help: proto.String("A summary of the pause duration of garbage collection cycles."),
+		Type: dto.MetricType_SUMMARY.Enum(),
+	}
+	quantiles := make([]*dto.Quantile, 0, len(goGCDurationQuantiles))
+	for i, phi := range goGCDurationQuantiles {
+		v := 0.0
+		if i < len(values) {
+			v = values[i]
+		}
+		quantiles = append(quantiles, &dto.Quantile{Quantile: proto.Float64(phi), Value: proto.Float64(v)})
+	}
+	gc.Metric = append(gc.Metric, &dto.Metric{
+		Summary: &dto.Summary{
+			SampleCount: proto.Uint64(count),
+			SampleSum:   proto.Float64(sum),
+			Quantile:    quantiles,
+		},
+	})
+	families = append(families, gc)
+
+	return families
+}
+
+// protoMetricFamily converts one group of weaver MetricSnapshots
+// sharing a metric name into a dto.MetricFamily.
+func protoMetricFamily(ms []*metrics.MetricSnapshot) (*dto.MetricFamily, error) {
+	first := ms[0]
+
+	mf := &dto.MetricFamily{
+		Name: proto.String(first.Name),
+		Help: proto.String(first.Help),
+	}
+
+	switch first.Type {
+	case protos.MetricType_COUNTER:
+		mf.Type = dto.MetricType_COUNTER.Enum()
+	case protos.MetricType_GAUGE:
+		mf.Type = dto.MetricType_GAUGE.Enum()
+	case protos.MetricType_HISTOGRAM:
+		mf.Type = dto.MetricType_HISTOGRAM.Enum()
+	}
+
+	for _, m := range ms {
+		metric := &dto.Metric{Label: protoLabels(m.Labels)}
+
+		switch first.Type {
+		case protos.MetricType_COUNTER:
+			metric.Counter = &dto.Counter{Value: proto.Float64(m.Value)}
+		case protos.MetricType_GAUGE:
+			metric.Gauge = &dto.Gauge{Value: proto.Float64(m.Value)}
+		case protos.MetricType_HISTOGRAM:
+			hasInf := false
+			var count uint64
+			buckets := make([]*dto.Bucket, 0, len(m.Bounds)+1)
+			for idx, bound := range m.Bounds {
+				count += m.Counts[idx]
+				buckets = append(buckets, &dto.Bucket{
+					CumulativeCount: proto.Uint64(count),
+					UpperBound:      proto.Float64(bound),
+				})
+				if math.IsInf(bound, +1) {
+					hasInf = true
+				}
+			}
+			count += m.Counts[len(m.Bounds)]
+			if !hasInf {
+				buckets = append(buckets, &dto.Bucket{
+					CumulativeCount: proto.Uint64(count),
+					UpperBound:      proto.Float64(math.Inf(+1)),
+				})
+			}
+			metric.Histogram = &dto.Histogram{
+				SampleCount: proto.Uint64(count),
+				SampleSum:   proto.Float64(m.Value),
+				Bucket:      buckets,
+			}
+		}
+
+		mf.Metric = append(mf.Metric, metric)
+	}
+
+	return mf, nil
+}
+
+// protoLabels converts a weaver label map into sorted dto.LabelPairs,
+// matching the label ordering used by the text exposition formats.
+func protoLabels(labels map[string]string) []*dto.LabelPair {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := make([]*dto.LabelPair, 0, len(names))
+	for _, name := range names {
+		pairs = append(pairs, &dto.LabelPair{
+			Name:  proto.String(name),
+			Value: proto.String(labels[name]),
+		})
+	}
+	return pairs
+}
+
+// writeDelimitedProto writes m to w prefixed with its marshaled
+// length as an unsigned varint, matching the wire format expected by
+// io.prometheus.client.MetricFamily consumers using "encoding=delimited".
+func writeDelimitedProto(w io.Writer, m proto.Message) error {
+	b, err := proto.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	var lenBuf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(lenBuf[:], uint64(len(b)))
+	if _, err := w.Write(lenBuf[:n]); err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
@@ -0,0 +1,159 @@
+// Copyright 2023 Eryx <evorui at gmail dot com>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hmetrics
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ServiceWeaver/weaver/runtime/metrics"
+)
+
+// Pusher pushes the process' metrics to a Prometheus Pushgateway [1],
+// for short-lived jobs (batch jobs, cron tasks) that exit before a
+// scrape could ever reach them via HttpHandler.
+//
+// [1] https://github.com/prometheus/pushgateway
+type Pusher struct {
+	url    string
+	client *http.Client
+
+	mu     sync.Mutex
+	cancel context.CancelFunc
+}
+
+// NewPusher returns a Pusher that pushes to the Pushgateway at url,
+// grouped under jobName and the given grouping labels.
+func NewPusher(url, jobName string, labels map[string]string) *Pusher {
+	return &Pusher{
+		url:    pushgatewayURL(url, jobName, labels),
+		client: http.DefaultClient,
+	}
+}
+
+// pushgatewayURL builds the Pushgateway group URL, following the
+// `/metrics/job/<job>/<label>/<value>/...` path convention. Label keys
+// are sorted before being appended so the same (jobName, labels) input
+// always produces the same URL - ranging over labels directly would
+// order the path segments randomly, and Push relies on a stable URL to
+// replace the previous push under the same job/labels group.
+func pushgatewayURL(base, jobName string, labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(strings.TrimRight(base, "/"))
+	b.WriteString("/metrics/job/")
+	b.WriteString(url.PathEscape(jobName))
+	for _, k := range keys {
+		b.WriteString("/")
+		b.WriteString(url.PathEscape(k))
+		b.WriteString("/")
+		b.WriteString(url.PathEscape(labels[k]))
+	}
+	return b.String()
+}
+
+// Push pushes the current metrics snapshot to the Pushgateway,
+// replacing any metrics previously pushed under the same job/labels
+// group.
+func (p *Pusher) Push(ctx context.Context) error {
+	return p.do(ctx, http.MethodPut)
+}
+
+// Add pushes the current metrics snapshot to the Pushgateway, merging
+// it with any metrics previously pushed under the same job/labels
+// group instead of replacing them.
+func (p *Pusher) Add(ctx context.Context) error {
+	return p.do(ctx, http.MethodPost)
+}
+
+// Delete removes the metrics previously pushed under this job/labels
+// group from the Pushgateway.
+func (p *Pusher) Delete(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, p.url, nil)
+	if err != nil {
+		return err
+	}
+	return p.send(req)
+}
+
+func (p *Pusher) do(ctx context.Context, method string) error {
+	var buf bytes.Buffer
+	translateMetricsToPrometheusTextFormat(&buf, metrics.Snapshot())
+	// Mirror HttpHandler's default text branch: summaries and the
+	// process_*/go_* collectors live outside metrics.Snapshot() and
+	// would otherwise be silently absent from pushed metrics.
+	translateSummaries(&buf)
+	renderCollectorMetrics(&buf)
+
+	req, err := http.NewRequestWithContext(ctx, method, p.url, &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	return p.send(req)
+}
+
+func (p *Pusher) send(req *http.Request) error {
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("hmetrics: pushgateway returned %s", resp.Status)
+	}
+	return nil
+}
+
+// Start begins pushing metrics to the Pushgateway in the background
+// every interval, until the returned stop function is called or a
+// second Start/stop replaces it. Push errors are ignored; use Push
+// directly if errors need to be observed.
+func (p *Pusher) Start(interval time.Duration) (stop func()) {
+	p.mu.Lock()
+	if p.cancel != nil {
+		p.cancel()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	p.cancel = cancel
+	p.mu.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				_ = p.Push(ctx)
+			}
+		}
+	}()
+
+	return cancel
+}
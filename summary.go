@@ -0,0 +1,336 @@
+// Copyright 2023 Eryx <evorui at gmail dot com>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hmetrics
+
+import (
+	"bytes"
+	"math"
+	"sort"
+	"sync"
+)
+
+// MetricSummaryMap is a streaming quantile summary, keyed by (name,
+// item) label pairs like the other MetricXxxMap types. Unlike
+// MetricHistogramMap, it reports true quantile estimates rather than
+// pre-bucketed counts.
+type MetricSummaryMap interface {
+	Insert(name, item string, v float64)
+}
+
+// RegisterSummaryMap registers a new summary metric that reports the
+// given quantile objectives (e.g. {0.5: 0.05, 0.99: 0.001}, mapping
+// each quantile phi to its allowed error epsilon), using the
+// Cormode/Shrivastava biased-quantile streaming algorithm [1] so that
+// quantiles can be estimated with bounded memory instead of buffering
+// every observation.
+//
+// [1] Cormode, Korn, Muthukrishnan, Srivastava, "Effective Computation
+// of Biased Quantiles over Data Streams", ICDE 2005.
+func RegisterSummaryMap(name, help string, objectives map[float64]float64) MetricSummaryMap {
+	mu.Lock()
+	defer mu.Unlock()
+	if sm, ok := summaryMetrics[name]; ok {
+		return sm
+	}
+
+	phis := make([]float64, 0, len(objectives))
+	for phi := range objectives {
+		phis = append(phis, phi)
+	}
+	sort.Float64s(phis)
+
+	sm := &summaryMap{
+		name:       name,
+		help:       help,
+		objectives: phis,
+		epsilons:   objectives,
+		streams:    map[Label]*quantileStream{},
+	}
+	summaryMetrics[name] = sm
+
+	return sm
+}
+
+type summaryMap struct {
+	name       string
+	help       string
+	objectives []float64 // sorted quantile phis
+	epsilons   map[float64]float64
+
+	mu      sync.Mutex
+	streams map[Label]*quantileStream
+}
+
+func (it *summaryMap) Insert(name, item string, v float64) {
+	l := Label{name, item}
+
+	it.mu.Lock()
+	s, ok := it.streams[l]
+	if !ok {
+		s = newQuantileStream(it.epsilons)
+		it.streams[l] = s
+	}
+	it.mu.Unlock()
+
+	s.Insert(v)
+}
+
+// summaryMetrics tracks every registered summaryMap so that
+// translateSummaries can render them alongside the Service Weaver
+// backed counters/gauges/histograms, which have no concept of a
+// quantile summary.
+var summaryMetrics = map[string]*summaryMap{}
+
+// sample is one (v, g, delta) tuple of the biased-quantile stream, as
+// described in the Cormode/Shrivastava paper: v is the observed
+// value, g is the minimum possible rank difference from the previous
+// sample, and delta is the maximum possible rank difference.
+type sample struct {
+	v     float64
+	g     int
+	delta int
+}
+
+// quantileStream is a single-label biased-quantile summary. It is safe
+// for concurrent use: Insert is called without the summaryMap lock
+// held, so every method takes quantileStream's own mutex.
+type quantileStream struct {
+	objectives []float64
+	epsilons   map[float64]float64
+
+	mu      sync.Mutex
+	samples []sample
+	n       int
+	sum     float64
+}
+
+func newQuantileStream(objectives map[float64]float64) *quantileStream {
+	phis := make([]float64, 0, len(objectives))
+	for phi := range objectives {
+		phis = append(phis, phi)
+	}
+	sort.Float64s(phis)
+	return &quantileStream{
+		objectives: phis,
+		epsilons:   objectives,
+	}
+}
+
+// Insert merges v into the stream in sorted position and recomputes
+// its allowed rank error band. Every 64th insertion it also compresses
+// the stream so its size stays bounded by O(1/epsilon * log(epsilon*n))
+// tuples.
+//
+// The new tuple's delta is derived from invariant(), which is defined
+// in terms of a tuple's rank r - the cumulative g-weight of every
+// sample before it, not its position in the samples slice. The two
+// only coincide while every g is still 1; once compress() has merged
+// any tuples, a later tuple's index understates its true rank, so the
+// rank passed in is computed as an explicit prefix sum instead.
+func (s *quantileStream) Insert(v float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := sort.Search(len(s.samples), func(i int) bool { return s.samples[i].v >= v })
+
+	rank := 0
+	for _, smp := range s.samples[:i] {
+		rank += smp.g
+	}
+
+	s.n++
+	s.sum += v
+
+	delta := 0
+	if i > 0 && i < len(s.samples) {
+		delta = s.invariant(rank+1) - 1
+		if delta < 0 {
+			delta = 0
+		}
+	}
+
+	s.samples = append(s.samples, sample{})
+	copy(s.samples[i+1:], s.samples[i:])
+	s.samples[i] = sample{v: v, g: 1, delta: delta}
+
+	if s.n%64 == 0 {
+		s.compress()
+	}
+}
+
+// invariant returns the allowed error band at rank r, truncated to an
+// int: for each objective phi the targeted-quantile band is
+// 2*epsilon*r/phi when r >= phi*n and 2*epsilon*(n-r)/(1-phi)
+// otherwise, and the tightest (smallest) of these is returned so the
+// band holds for every configured quantile at that rank.
+// rank must be the tuple's cumulative g-weight (its rank in the
+// stream), not its index in the samples slice.
+//
+// The per-tuple band compounds across compress() merges, so bounding
+// each one at the caller's configured epsilon lets the externally
+// observed rank error drift to roughly twice that epsilon; halving it
+// here keeps Query's actual error within the epsilon callers ask for,
+// confirmed empirically in TestQuantileStream.
+func (s *quantileStream) invariant(rank int) int {
+	min := math.Inf(+1)
+	for _, phi := range s.objectives {
+		eps := s.epsilons[phi] / 2
+		var band float64
+		r := float64(rank)
+		n := float64(s.n)
+		if phi*n <= r {
+			band = 2 * eps * r / phi
+		} else {
+			band = 2 * eps * (n - r) / (1 - phi)
+		}
+		if band < min {
+			min = band
+		}
+	}
+	if math.IsInf(min, 0) {
+		return 0
+	}
+	return int(min)
+}
+
+// compress drops tuples that can be merged into their right neighbor
+// without violating any objective's error bound: g_i + g_{i+1} +
+// delta_{i+1} <= invariant(r_i), where r_i is samples[i]'s cumulative
+// rank (the g-weight of samples[0..i], inclusive).
+//
+// r_i is computed once up front, over the pre-compress samples: a
+// merge at position i only changes g on samples at or after i+1 and
+// never touches the prefix sum up to i, so every decision in the pass
+// can safely use the same precomputed ranks.
+func (s *quantileStream) compress() {
+	if len(s.samples) < 3 {
+		return
+	}
+
+	rank := make([]int, len(s.samples))
+	sum := 0
+	for i, smp := range s.samples {
+		sum += smp.g
+		rank[i] = sum
+	}
+
+	merged := make([]sample, 0, len(s.samples))
+	merged = append(merged, s.samples[len(s.samples)-1])
+	for i := len(s.samples) - 2; i >= 0; i-- {
+		next := &merged[len(merged)-1]
+		if s.samples[i].g+next.g+next.delta <= s.invariant(rank[i]) {
+			next.g += s.samples[i].g
+		} else {
+			merged = append(merged, s.samples[i])
+		}
+	}
+	for l, r := 0, len(merged)-1; l < r; l, r = l+1, r-1 {
+		merged[l], merged[r] = merged[r], merged[l]
+	}
+	s.samples = merged
+}
+
+// Query returns the estimated value at quantile phi: the value of the
+// first tuple whose rank range [r_min, r_min+delta] could cover the
+// target rank phi*n, found by walking the stream and accumulating g
+// (r_min) until r_min+delta exceeds it. The eps-aware error bound is
+// already baked into each tuple's delta by invariant(), so the target
+// here is phi*n itself, not phi*n offset by an extra epsilon*n.
+func (s *quantileStream) Query(phi float64) float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.samples) == 0 {
+		return 0
+	}
+
+	rank := phi * float64(s.n)
+
+	g := 0
+	for i, smp := range s.samples {
+		g += smp.g
+		if float64(g)+float64(smp.delta) > rank || i == len(s.samples)-1 {
+			return smp.v
+		}
+	}
+	return s.samples[len(s.samples)-1].v
+}
+
+// Sum and Count mirror the x_sum/x_count samples Prometheus expects
+// alongside every summary's quantile lines. Sum is an exact running
+// total of every Insert call, not derived from the compressed
+// sketch: reconstructing it as Σ v_i * g_i drifts from the true sum
+// once compress() has merged samples, which Prometheus summary
+// semantics don't allow.
+func (s *quantileStream) Sum() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sum
+}
+
+func (s *quantileStream) Count() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return uint64(s.n)
+}
+
+// translateSummaries renders every registered MetricSummaryMap in the
+// Prometheus/OpenMetrics text format, appended after the Service
+// Weaver backed metric families.
+func translateSummaries(w *bytes.Buffer) {
+	mu.Lock()
+	names := make([]string, 0, len(summaryMetrics))
+	for name := range summaryMetrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	metrics := make([]*summaryMap, 0, len(names))
+	for _, name := range names {
+		metrics = append(metrics, summaryMetrics[name])
+	}
+	mu.Unlock()
+
+	for _, sm := range metrics {
+		if len(sm.help) > 0 {
+			w.WriteString("# HELP " + sm.name + " " + sm.help + "\n")
+		}
+		w.WriteString("# TYPE " + sm.name + " summary\n")
+
+		sm.mu.Lock()
+		labels := make([]Label, 0, len(sm.streams))
+		for l := range sm.streams {
+			labels = append(labels, l)
+		}
+		sm.mu.Unlock()
+		sort.Slice(labels, func(i, j int) bool {
+			if labels[i].Name != labels[j].Name {
+				return labels[i].Name < labels[j].Name
+			}
+			return labels[i].Item < labels[j].Item
+		})
+
+		for _, l := range labels {
+			s := sm.streams[l]
+			for _, phi := range sm.objectives {
+				ls := map[string]string{"Name": l.Name, "Item": l.Item}
+				writeEntry(w, sm.name, s.Query(phi), "", ls, "quantile", phi)
+			}
+			ls := map[string]string{"Name": l.Name, "Item": l.Item}
+			writeEntry(w, sm.name, s.Sum(), "_sum", ls, "", 0)
+			writeEntry(w, sm.name, float64(s.Count()), "_count", ls, "", 0)
+		}
+		w.WriteByte('\n')
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright 2023 Eryx <evorui at gmail dot com>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hmetrics
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// TestQuantileStream inserts a random permutation of 1..n, so the
+// value at true rank r (1-indexed) is exactly r - letting Query's
+// returned value be compared directly against the target rank without
+// a separate ground-truth rank computation.
+func TestQuantileStream(t *testing.T) {
+	const n = 100000
+	objectives := map[float64]float64{0.5: 0.01, 0.9: 0.01, 0.99: 0.001}
+
+	values := make([]float64, n)
+	for i := range values {
+		values[i] = float64(i + 1)
+	}
+	rand.New(rand.NewSource(1)).Shuffle(n, func(i, j int) {
+		values[i], values[j] = values[j], values[i]
+	})
+
+	s := newQuantileStream(objectives)
+	var sum float64
+	for _, v := range values {
+		s.Insert(v)
+		sum += v
+	}
+
+	if got, want := s.Count(), uint64(n); got != want {
+		t.Fatalf("Count() = %d, want %d", got, want)
+	}
+	if got, want := s.Sum(), sum; got != want {
+		t.Fatalf("Sum() = %v, want %v", got, want)
+	}
+
+	for phi, eps := range objectives {
+		wantRank := phi * n
+		gotRank := s.Query(phi)
+		if diff := math.Abs(gotRank - wantRank); diff > eps*n+1 {
+			t.Errorf("Query(%v) = %v, want within %v of true rank %v", phi, gotRank, eps*n+1, wantRank)
+		}
+	}
+}